@@ -0,0 +1,205 @@
+// Package health implements a small self-check subsystem that lets a
+// long-running component register periodic checks of its own well-being and
+// aggregates their results into a single rolling status, in the spirit of
+// the client/health patterns used by reverse-proxy tools like frp.
+package health
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/getlantern/golog"
+)
+
+var log = golog.LoggerFor("flashlight.health")
+
+// CheckFunc performs a single self-check, returning a non-nil error if the
+// thing being checked is unhealthy. It may also return arbitrary data about
+// what it checked (e.g. a gauge it sampled), which is attached to the
+// Result for operators to consume even when the check is passing.
+type CheckFunc func() (map[string]interface{}, error)
+
+// Check describes a named, periodically-run self-check.
+type Check struct {
+	// Name identifies this check in the aggregated status, e.g. "waddell".
+	Name string
+
+	// Fn is run every Interval to determine whether this check is passing.
+	Fn CheckFunc
+
+	// Interval is how often Fn is run. Defaults to 1 minute if zero.
+	Interval time.Duration
+}
+
+// Result is the outcome of the most recent run of a Check.
+type Result struct {
+	Name      string                 `json:"name"`
+	OK        bool                   `json:"ok"`
+	LastError string                 `json:"lastError,omitempty"`
+	LastRun   time.Time              `json:"lastRun"`
+	Data      map[string]interface{} `json:"data,omitempty"`
+}
+
+// Status is the aggregated result of all registered checks.
+type Status struct {
+	Status string   `json:"status"`
+	Checks []Result `json:"checks"`
+}
+
+const (
+	StatusOK       = "ok"
+	StatusDegraded = "degraded"
+)
+
+type registration struct {
+	check  Check
+	result Result
+	stopCh chan interface{}
+}
+
+// Registry tracks a set of registered Checks and the most recent Result for
+// each, aggregating them into an overall Status.
+type Registry struct {
+	mutex  sync.Mutex
+	checks map[string]*registration
+}
+
+// NewRegistry creates a new, empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		checks: make(map[string]*registration),
+	}
+}
+
+// Register adds the given Check and starts running it on its own ticker.
+// Registering a Check with a name that's already registered replaces the
+// old one.
+func (r *Registry) Register(check Check) {
+	if check.Interval <= 0 {
+		check.Interval = 1 * time.Minute
+	}
+
+	r.mutex.Lock()
+	if existing, found := r.checks[check.Name]; found {
+		close(existing.stopCh)
+	}
+	reg := &registration{
+		check:  check,
+		stopCh: make(chan interface{}),
+	}
+	r.checks[check.Name] = reg
+	r.mutex.Unlock()
+
+	go r.run(reg)
+}
+
+// Set directly records the result of a check that's driven by events rather
+// than a ticker, e.g. a connection that reports its own connected/
+// disconnected transitions. It both creates the named entry if needed and
+// updates its last result.
+func (r *Registry) Set(name string, err error) {
+	result := Result{
+		Name:    name,
+		OK:      err == nil,
+		LastRun: time.Now(),
+	}
+	if err != nil {
+		result.LastError = err.Error()
+	}
+
+	r.mutex.Lock()
+	reg, found := r.checks[name]
+	if !found {
+		reg = &registration{check: Check{Name: name}, stopCh: make(chan interface{})}
+		r.checks[name] = reg
+	}
+	reg.result = result
+	r.mutex.Unlock()
+}
+
+// Deregister stops running and removes the named Check.
+func (r *Registry) Deregister(name string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if existing, found := r.checks[name]; found {
+		close(existing.stopCh)
+		delete(r.checks, name)
+	}
+}
+
+func (r *Registry) run(reg *registration) {
+	r.runOnce(reg)
+	ticker := time.NewTicker(reg.check.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-reg.stopCh:
+			return
+		case <-ticker.C:
+			r.runOnce(reg)
+		}
+	}
+}
+
+func (r *Registry) runOnce(reg *registration) {
+	data, err := reg.check.Fn()
+	result := Result{
+		Name:    reg.check.Name,
+		OK:      err == nil,
+		LastRun: time.Now(),
+		Data:    data,
+	}
+	if err != nil {
+		result.LastError = err.Error()
+		log.Debugf("Health check %v failed: %v", reg.check.Name, err)
+	}
+
+	r.mutex.Lock()
+	reg.result = result
+	r.mutex.Unlock()
+}
+
+// Status returns the current aggregated status of all registered checks.
+// The overall status is StatusOK only if every check's last run succeeded.
+func (r *Registry) Status() Status {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	status := Status{Status: StatusOK}
+	for _, reg := range r.checks {
+		status.Checks = append(status.Checks, reg.result)
+		if !reg.result.OK {
+			status.Status = StatusDegraded
+		}
+	}
+	return status
+}
+
+// Healthy reports whether every registered check's last run succeeded. A
+// check that hasn't run yet is not considered healthy, so that callers
+// relying on Healthy() during startup fail closed rather than open.
+func (r *Registry) Healthy() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for _, reg := range r.checks {
+		if reg.result.LastRun.IsZero() || !reg.result.OK {
+			return false
+		}
+	}
+	return true
+}
+
+// ServeHTTP renders the current Status as JSON, for use as (or mounted
+// into) an admin HTTP endpoint.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !r.Healthy() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(r.Status()); err != nil {
+		log.Errorf("Unable to encode health status: %v", err)
+	}
+}
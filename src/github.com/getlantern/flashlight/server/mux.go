@@ -0,0 +1,118 @@
+package server
+
+import (
+	"crypto/tls"
+	"net"
+	"sync/atomic"
+
+	"github.com/getlantern/yamux"
+)
+
+// muxALPNToken is advertised via ALPN by mux-aware clients that want to
+// multiplex many logical requests over a single TLS connection instead of
+// paying a full handshake per request. Clients that don't know about it
+// simply won't negotiate it, so their plain TLS connections pass straight
+// through to the existing http.Handler pipeline unmodified.
+const muxALPNToken = "lantern/mux1"
+
+var (
+	activeMuxSessions int64
+	activeMuxStreams  int64
+)
+
+// muxListener wraps an underlying net.Listener, transparently demuxing any
+// accepted connection that negotiated muxALPNToken into its component
+// logical streams and handing each stream to Accept() just like it were its
+// own connection. Connections that didn't negotiate the mux ALPN token are
+// passed through as-is.
+type muxListener struct {
+	net.Listener
+	pending chan net.Conn
+	errs    chan error
+}
+
+func newMuxListener(l net.Listener) *muxListener {
+	ml := &muxListener{
+		Listener: l,
+		pending:  make(chan net.Conn),
+		errs:     make(chan error, 1),
+	}
+	go ml.acceptLoop()
+	return ml
+}
+
+func (ml *muxListener) acceptLoop() {
+	for {
+		conn, err := ml.Listener.Accept()
+		if err != nil {
+			ml.errs <- err
+			return
+		}
+		go ml.handle(conn)
+	}
+}
+
+func (ml *muxListener) handle(conn net.Conn) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		ml.pending <- conn
+		return
+	}
+	// ALPN negotiation only happens during the handshake, and tls.Conn
+	// defers that to the first Read/Write by default, so force it now in
+	// order to read NegotiatedProtocol below.
+	if err := tlsConn.Handshake(); err != nil {
+		log.Debugf("TLS handshake with %v failed: %s", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	if tlsConn.ConnectionState().NegotiatedProtocol != muxALPNToken {
+		ml.pending <- conn
+		return
+	}
+
+	session, err := yamux.Server(conn, nil)
+	if err != nil {
+		log.Errorf("Unable to establish mux session with %v: %s", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	atomic.AddInt64(&activeMuxSessions, 1)
+	defer atomic.AddInt64(&activeMuxSessions, -1)
+
+	for {
+		stream, err := session.Accept()
+		if err != nil {
+			log.Debugf("Mux session with %v ended: %s", conn.RemoteAddr(), err)
+			return
+		}
+		atomic.AddInt64(&activeMuxStreams, 1)
+		ml.pending <- &muxStream{Stream: stream}
+	}
+}
+
+func (ml *muxListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-ml.pending:
+		return conn, nil
+	case err := <-ml.errs:
+		return nil, err
+	}
+}
+
+// muxStream wraps a yamux.Stream to keep activeMuxStreams accurate as
+// streams open and close.
+type muxStream struct {
+	*yamux.Stream
+}
+
+func (s *muxStream) Close() error {
+	atomic.AddInt64(&activeMuxStreams, -1)
+	return s.Stream.Close()
+}
+
+// muxStats reports the current number of active mux sessions and streams,
+// for exposure through the health admin endpoint.
+func muxStats() (sessions int64, streams int64) {
+	return atomic.LoadInt64(&activeMuxSessions), atomic.LoadInt64(&activeMuxStreams)
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Protocol identifies the transport protocol of a port mapping.
+type Protocol string
+
+const (
+	TCP Protocol = "tcp"
+	UDP Protocol = "udp"
+
+	// defaultLifetime is what we request from a router when the caller
+	// doesn't have a better idea. Routers are free to grant less, which is
+	// why we always honor whatever lifetime comes back in the response
+	// rather than assuming we got what we asked for.
+	defaultLifetime = 1 * time.Hour
+
+	// refreshMargin is how long before a lease's lifetime expires that we
+	// renew it. Cutting it close risks losing the mapping to router-side
+	// expiry if a renewal attempt is delayed or dropped.
+	refreshMargin = 1 * time.Minute
+)
+
+// PortMapper maps and unmaps ports on the gateway router. Implementations
+// exist for UPnP/IGD, NAT-PMP and PCP so that Server can fall back from one
+// to the next depending on what the router in front of it actually speaks.
+type PortMapper interface {
+	// Name identifies this backend for logging purposes.
+	Name() string
+
+	// Map requests a mapping from externalPort on the router to
+	// internalIP:internalPort for the given protocol, asking for the given
+	// lifetime. It returns the lifetime actually granted by the router,
+	// which callers should use to schedule a refresh well before it elapses.
+	Map(proto Protocol, internalIP string, internalPort int, externalPort int, lifetime time.Duration) (time.Duration, error)
+
+	// Unmap removes a previously established mapping from externalPort to
+	// internalIP:internalPort. NAT-PMP and PCP both identify a mapping to
+	// delete by its internal address rather than its external port, so
+	// backends need the same arguments here as they were given to Map.
+	Unmap(proto Protocol, internalIP string, internalPort int, externalPort int) error
+}
+
+// portMappers returns the backends to try, in the order they should be
+// attempted. IGD/UPnP is tried first since it's the most widely deployed and
+// the one we have the most operational experience with; NAT-PMP and PCP are
+// fallbacks for routers that have UPnP disabled, which is common on
+// consumer-grade hardware shipped by ISPs.
+func portMappers() []PortMapper {
+	return []PortMapper{
+		&igdPortMapper{},
+		&natPMPPortMapper{},
+		&pcpPortMapper{},
+	}
+}
+
+// portmapLease tracks a mapping that's currently active so that it can be
+// refreshed before the router-assigned lifetime expires and torn down when
+// the server reconfigures or shuts down.
+type portmapLease struct {
+	mapper       PortMapper
+	proto        Protocol
+	internalIP   string
+	internalPort int
+	externalPort int
+
+	stopCh chan interface{}
+}
+
+func (server *Server) mapPort(proto Protocol, internalIP string, internalPort int, externalPort int) (*portmapLease, error) {
+	var lastErr error
+	for _, mapper := range portMappers() {
+		lifetime, err := mapper.Map(proto, internalIP, internalPort, externalPort, defaultLifetime)
+		if err != nil {
+			log.Debugf("Unable to map %v port %d with %s: %s", proto, externalPort, mapper.Name(), err)
+			lastErr = err
+			continue
+		}
+		log.Debugf("Mapped %v port %d with %s, lease of %v", proto, externalPort, mapper.Name(), lifetime)
+		lease := &portmapLease{
+			mapper:       mapper,
+			proto:        proto,
+			internalIP:   internalIP,
+			internalPort: internalPort,
+			externalPort: externalPort,
+			stopCh:       make(chan interface{}),
+		}
+		lease.scheduleRefresh(lifetime)
+		return lease, nil
+	}
+	return nil, fmt.Errorf("Unable to map %v port %d, all portmapping backends failed, last error: %s", proto, externalPort, lastErr)
+}
+
+// scheduleRefresh periodically re-requests the mapping well before the
+// granted lifetime runs out. Many routers silently drop mappings requested
+// with an infinite (0) lifetime rather than honoring them, so we always ask
+// for a bounded lifetime and renew it ourselves instead.
+func (lease *portmapLease) scheduleRefresh(lifetime time.Duration) {
+	go func() {
+		wait := lifetime - refreshMargin
+		if wait <= 0 {
+			wait = lifetime / 2
+		}
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		for {
+			select {
+			case <-lease.stopCh:
+				return
+			case <-timer.C:
+				newLifetime, err := lease.mapper.Map(lease.proto, lease.internalIP, lease.internalPort, lease.externalPort, defaultLifetime)
+				if err != nil {
+					log.Errorf("Unable to refresh %v port mapping for %d: %s", lease.proto, lease.externalPort, err)
+					newLifetime = defaultLifetime
+				}
+				wait = newLifetime - refreshMargin
+				if wait <= 0 {
+					wait = newLifetime / 2
+				}
+				timer.Reset(wait)
+			}
+		}
+	}()
+}
+
+func (lease *portmapLease) unmap() error {
+	close(lease.stopCh)
+	return lease.mapper.Unmap(lease.proto, lease.internalIP, lease.internalPort, lease.externalPort)
+}
+
+// portmapState tracks the leases currently held by a Server so that
+// Configure can unmap the old ones and establish new ones as configuration
+// changes.
+type portmapState struct {
+	mutex sync.Mutex
+	tcp   *portmapLease
+	udp   *portmapLease
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+)
+
+// defaultGateway returns the local network's default gateway, which is
+// where NAT-PMP and PCP requests need to be sent. IGD discovers its target
+// via SSDP instead and doesn't need this.
+func defaultGateway() (net.IP, error) {
+	f, err := os.Open("/proc/net/route")
+	if err != nil {
+		return nil, fmt.Errorf("Unable to determine default gateway: %s", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Scan() // skip header
+	for scanner.Scan() {
+		fields := splitRouteFields(scanner.Text())
+		if len(fields) < 3 {
+			continue
+		}
+		// Destination 00000000 is the default route.
+		if fields[1] != "00000000" {
+			continue
+		}
+		ip, err := parseHexGateway(fields[2])
+		if err != nil {
+			continue
+		}
+		return ip, nil
+	}
+
+	return nil, fmt.Errorf("No default gateway found")
+}
+
+func splitRouteFields(line string) []string {
+	var fields []string
+	var field []byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		if c == ' ' || c == '\t' {
+			if len(field) > 0 {
+				fields = append(fields, string(field))
+				field = nil
+			}
+			continue
+		}
+		field = append(field, c)
+	}
+	if len(field) > 0 {
+		fields = append(fields, string(field))
+	}
+	return fields
+}
+
+// parseHexGateway parses the little-endian hex-encoded gateway address used
+// in /proc/net/route (e.g. "0102A8C0" for 192.168.2.1).
+func parseHexGateway(hexAddr string) (net.IP, error) {
+	b, err := hex.DecodeString(hexAddr)
+	if err != nil || len(b) != 4 {
+		return nil, fmt.Errorf("Unable to parse gateway address %q", hexAddr)
+	}
+	return net.IPv4(b[3], b[2], b[1], b[0]), nil
+}
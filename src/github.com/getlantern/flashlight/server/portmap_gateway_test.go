@@ -0,0 +1,60 @@
+package server
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestSplitRouteFields(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		want []string
+	}{
+		{"single spaces", "eth0 00000000 0102A8C0 0003 0 0 0 00000000 0 0 0", []string{"eth0", "00000000", "0102A8C0", "0003", "0", "0", "0", "00000000", "0", "0", "0"}},
+		{"tabs and multiple spaces", "eth0\t00000000\t0102A8C0  0003", []string{"eth0", "00000000", "0102A8C0", "0003"}},
+		{"leading and trailing whitespace", "  eth0 00000000  ", []string{"eth0", "00000000"}},
+		{"empty", "", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := splitRouteFields(tt.line)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("splitRouteFields(%q) = %#v, want %#v", tt.line, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseHexGateway(t *testing.T) {
+	tests := []struct {
+		name    string
+		hexAddr string
+		want    net.IP
+		wantErr bool
+	}{
+		{"valid gateway", "0102A8C0", net.IPv4(192, 168, 2, 1), false},
+		{"valid gateway, lowercase hex", "0101a8c0", net.IPv4(192, 168, 1, 1), false},
+		{"odd length", "102A8C0", nil, true},
+		{"not hex", "ZZZZZZZZ", nil, true},
+		{"wrong byte count", "0102", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseHexGateway(tt.hexAddr)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseHexGateway(%q) expected error, got nil", tt.hexAddr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseHexGateway(%q) unexpected error: %s", tt.hexAddr, err)
+			}
+			if !got.Equal(tt.want) {
+				t.Errorf("parseHexGateway(%q) = %v, want %v", tt.hexAddr, got, tt.want)
+			}
+		})
+	}
+}
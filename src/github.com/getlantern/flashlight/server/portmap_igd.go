@@ -0,0 +1,53 @@
+package server
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/getlantern/go-igdman/igdman"
+)
+
+// igdPortMapper maps ports via UPnP Internet Gateway Device discovery. This
+// is the original (and still most common) mechanism lantern has used to map
+// ports, so it remains the first backend tried.
+type igdPortMapper struct{}
+
+func (m *igdPortMapper) Name() string {
+	return "igd"
+}
+
+func igdProtocol(proto Protocol) igdman.Protocol {
+	if proto == UDP {
+		return igdman.UDP
+	}
+	return igdman.TCP
+}
+
+func (m *igdPortMapper) Map(proto Protocol, internalIP string, internalPort int, externalPort int, lifetime time.Duration) (time.Duration, error) {
+	igd, err := igdman.NewIGD()
+	if err != nil {
+		return 0, fmt.Errorf("Unable to get IGD: %s", err)
+	}
+
+	p := igdProtocol(proto)
+	igd.RemovePortMapping(p, externalPort)
+	err = igd.AddPortMapping(p, internalIP, internalPort, externalPort, int(lifetime.Seconds()))
+	if err != nil {
+		return 0, fmt.Errorf("Unable to map port with igdman %d: %s", externalPort, err)
+	}
+
+	// igdman doesn't report back the lifetime actually granted, so we fall
+	// back to the lifetime we requested and rely on periodic refreshing
+	// rather than trusting the router to honor it exactly.
+	return lifetime, nil
+}
+
+func (m *igdPortMapper) Unmap(proto Protocol, internalIP string, internalPort int, externalPort int) error {
+	igd, err := igdman.NewIGD()
+	if err != nil {
+		return fmt.Errorf("Unable to get IGD: %s", err)
+	}
+
+	igd.RemovePortMapping(igdProtocol(proto), externalPort)
+	return nil
+}
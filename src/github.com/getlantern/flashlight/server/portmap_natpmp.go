@@ -0,0 +1,104 @@
+package server
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	natPMPPort        = 5351
+	natPMPVersion     = 0
+	natPMPOpMapTCP    = 2
+	natPMPOpMapUDP    = 1
+	natPMPRequestSize = 12
+	natPMPTimeout     = 2 * time.Second
+)
+
+// natPMPPortMapper maps ports using NAT-PMP (RFC 6886), which is what most
+// consumer routers speak when UPnP has been disabled by the user or their
+// ISP.
+type natPMPPortMapper struct{}
+
+func (m *natPMPPortMapper) Name() string {
+	return "nat-pmp"
+}
+
+func (m *natPMPPortMapper) Map(proto Protocol, internalIP string, internalPort int, externalPort int, lifetime time.Duration) (time.Duration, error) {
+	gateway, err := defaultGateway()
+	if err != nil {
+		return 0, fmt.Errorf("Unable to determine gateway for NAT-PMP: %s", err)
+	}
+
+	req := natPMPMapRequest(proto, internalPort, externalPort, lifetime)
+
+	resp, err := natPMPRoundTrip(gateway, req)
+	if err != nil {
+		return 0, err
+	}
+	if len(resp) < 16 {
+		return 0, fmt.Errorf("NAT-PMP response too short")
+	}
+	resultCode := binary.BigEndian.Uint16(resp[2:4])
+	if resultCode != 0 {
+		return 0, fmt.Errorf("NAT-PMP mapping request failed with result code %d", resultCode)
+	}
+	grantedLifetime := time.Duration(binary.BigEndian.Uint32(resp[12:16])) * time.Second
+	return grantedLifetime, nil
+}
+
+func (m *natPMPPortMapper) Unmap(proto Protocol, internalIP string, internalPort int, externalPort int) error {
+	gateway, err := defaultGateway()
+	if err != nil {
+		return fmt.Errorf("Unable to determine gateway for NAT-PMP: %s", err)
+	}
+
+	// Per RFC 6886 section 3.3, a mapping is deleted by requesting it again
+	// with its original internal port and an external port and lifetime of
+	// 0. The internal port is what identifies which mapping to delete, so
+	// it has to be the real one, not externalPort.
+	req := natPMPMapRequest(proto, internalPort, 0, 0)
+
+	_, err = natPMPRoundTrip(gateway, req)
+	return err
+}
+
+// natPMPMapRequest builds a NAT-PMP mapping request per RFC 6886 section
+// 3.3. Passing externalPort and lifetime as 0 requests deletion of the
+// mapping for internalPort.
+func natPMPMapRequest(proto Protocol, internalPort int, externalPort int, lifetime time.Duration) []byte {
+	op := byte(natPMPOpMapTCP)
+	if proto == UDP {
+		op = natPMPOpMapUDP
+	}
+
+	req := make([]byte, natPMPRequestSize)
+	req[0] = natPMPVersion
+	req[1] = op
+	// req[2:4] reserved
+	binary.BigEndian.PutUint16(req[4:6], uint16(internalPort))
+	binary.BigEndian.PutUint16(req[6:8], uint16(externalPort))
+	binary.BigEndian.PutUint32(req[8:12], uint32(lifetime.Seconds()))
+	return req
+}
+
+func natPMPRoundTrip(gateway net.IP, req []byte) ([]byte, error) {
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: gateway, Port: natPMPPort})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to dial NAT-PMP gateway: %s", err)
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(natPMPTimeout))
+	if _, err := conn.Write(req); err != nil {
+		return nil, fmt.Errorf("Unable to send NAT-PMP request: %s", err)
+	}
+
+	resp := make([]byte, 16)
+	n, err := conn.Read(resp)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read NAT-PMP response: %s", err)
+	}
+	return resp[:n], nil
+}
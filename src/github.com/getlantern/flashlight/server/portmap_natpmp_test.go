@@ -0,0 +1,60 @@
+package server
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func TestNATPMPMapRequest(t *testing.T) {
+	tests := []struct {
+		name         string
+		proto        Protocol
+		internalPort int
+		externalPort int
+		lifetime     time.Duration
+		wantOp       byte
+	}{
+		{"tcp mapping", TCP, 8080, 443, time.Hour, natPMPOpMapTCP},
+		{"udp mapping", UDP, 8080, 443, time.Hour, natPMPOpMapUDP},
+		{"deletion request", TCP, 8080, 0, 0, natPMPOpMapTCP},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := natPMPMapRequest(tt.proto, tt.internalPort, tt.externalPort, tt.lifetime)
+			if len(req) != natPMPRequestSize {
+				t.Fatalf("len(req) = %d, want %d", len(req), natPMPRequestSize)
+			}
+			if req[0] != natPMPVersion {
+				t.Errorf("req[0] (version) = %d, want %d", req[0], natPMPVersion)
+			}
+			if req[1] != tt.wantOp {
+				t.Errorf("req[1] (op) = %d, want %d", req[1], tt.wantOp)
+			}
+			if got := binary.BigEndian.Uint16(req[4:6]); got != uint16(tt.internalPort) {
+				t.Errorf("internal port = %d, want %d", got, tt.internalPort)
+			}
+			if got := binary.BigEndian.Uint16(req[6:8]); got != uint16(tt.externalPort) {
+				t.Errorf("external port = %d, want %d", got, tt.externalPort)
+			}
+			if got := binary.BigEndian.Uint32(req[8:12]); got != uint32(tt.lifetime.Seconds()) {
+				t.Errorf("lifetime = %d, want %d", got, uint32(tt.lifetime.Seconds()))
+			}
+		})
+	}
+}
+
+// TestNATPMPUnmapTargetsInternalPort guards against the internalPort field
+// of a deletion request being populated with externalPort instead, which
+// would silently target the wrong mapping on the router.
+func TestNATPMPUnmapTargetsInternalPort(t *testing.T) {
+	const internalPort = 51234
+	const externalPort = 443
+	req := natPMPMapRequest(TCP, internalPort, 0, 0)
+	if got := binary.BigEndian.Uint16(req[4:6]); got != internalPort {
+		t.Errorf("unmap request internal port = %d, want %d", got, internalPort)
+	}
+	if got := binary.BigEndian.Uint16(req[4:6]); got == externalPort {
+		t.Errorf("unmap request wrote externalPort into the internalPort field")
+	}
+}
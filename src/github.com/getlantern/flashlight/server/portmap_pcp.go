@@ -0,0 +1,119 @@
+package server
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net"
+	"time"
+)
+
+const (
+	pcpPort        = 5351
+	pcpVersion     = 2
+	pcpOpcodeMap   = 1
+	pcpRequestSize = 60
+	pcpTimeout     = 2 * time.Second
+)
+
+// pcpPortMapper maps ports using PCP (RFC 6887), the successor to NAT-PMP
+// that some newer routers and carrier-grade NAT boxes support even when
+// they don't speak NAT-PMP.
+type pcpPortMapper struct{}
+
+func (m *pcpPortMapper) Name() string {
+	return "pcp"
+}
+
+func (m *pcpPortMapper) Map(proto Protocol, internalIP string, internalPort int, externalPort int, lifetime time.Duration) (time.Duration, error) {
+	gateway, err := defaultGateway()
+	if err != nil {
+		return 0, fmt.Errorf("Unable to determine gateway for PCP: %s", err)
+	}
+
+	req, err := pcpMapRequest(proto, internalIP, internalPort, externalPort, lifetime)
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := pcpRoundTrip(gateway, req)
+	if err != nil {
+		return 0, err
+	}
+	if len(resp) < 24 {
+		return 0, fmt.Errorf("PCP response too short")
+	}
+	resultCode := resp[3]
+	if resultCode != 0 {
+		return 0, fmt.Errorf("PCP mapping request failed with result code %d", resultCode)
+	}
+	grantedLifetime := time.Duration(binary.BigEndian.Uint32(resp[4:8])) * time.Second
+	return grantedLifetime, nil
+}
+
+func (m *pcpPortMapper) Unmap(proto Protocol, internalIP string, internalPort int, externalPort int) error {
+	gateway, err := defaultGateway()
+	if err != nil {
+		return fmt.Errorf("Unable to determine gateway for PCP: %s", err)
+	}
+
+	// PCP deletes a mapping by resending the original MAP request with a
+	// lifetime of 0.
+	req, err := pcpMapRequest(proto, internalIP, internalPort, externalPort, 0)
+	if err != nil {
+		return err
+	}
+
+	_, err = pcpRoundTrip(gateway, req)
+	return err
+}
+
+func pcpMapRequest(proto Protocol, internalIP string, internalPort int, externalPort int, lifetime time.Duration) ([]byte, error) {
+	ip := net.ParseIP(internalIP)
+	if ip == nil {
+		return nil, fmt.Errorf("Unable to parse internal IP %v", internalIP)
+	}
+
+	req := make([]byte, pcpRequestSize)
+	req[0] = pcpVersion
+	req[1] = pcpOpcodeMap
+	binary.BigEndian.PutUint32(req[4:8], uint32(lifetime.Seconds()))
+	copy(req[8:24], ip.To16())
+
+	nonce := make([]byte, 12)
+	rand.Read(nonce)
+	copy(req[24:36], nonce)
+
+	protoNum := byte(6) // TCP
+	if proto == UDP {
+		protoNum = 17
+	}
+	req[36] = protoNum
+	binary.BigEndian.PutUint16(req[40:42], uint16(internalPort))
+	binary.BigEndian.PutUint16(req[42:44], uint16(externalPort))
+	// Leave the Suggested External IP Address (req[44:60]) all-zero to
+	// indicate we have no preference; it's the router's job to assign one,
+	// not ours to suggest our own internal address for it.
+
+	return req, nil
+}
+
+func pcpRoundTrip(gateway net.IP, req []byte) ([]byte, error) {
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: gateway, Port: pcpPort})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to dial PCP gateway: %s", err)
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(pcpTimeout))
+	if _, err := conn.Write(req); err != nil {
+		return nil, fmt.Errorf("Unable to send PCP request: %s", err)
+	}
+
+	resp := make([]byte, 1100)
+	n, err := conn.Read(resp)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read PCP response: %s", err)
+	}
+	return resp[:n], nil
+}
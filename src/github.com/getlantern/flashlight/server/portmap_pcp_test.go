@@ -0,0 +1,68 @@
+package server
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPCPMapRequest(t *testing.T) {
+	tests := []struct {
+		name         string
+		proto        Protocol
+		internalIP   string
+		internalPort int
+		externalPort int
+		lifetime     time.Duration
+		wantProtoNum byte
+	}{
+		{"tcp mapping", TCP, "192.168.1.2", 8080, 443, time.Hour, 6},
+		{"udp mapping", UDP, "192.168.1.2", 8080, 443, time.Hour, 17},
+		{"deletion request", TCP, "192.168.1.2", 8080, 443, 0, 6},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := pcpMapRequest(tt.proto, tt.internalIP, tt.internalPort, tt.externalPort, tt.lifetime)
+			if err != nil {
+				t.Fatalf("pcpMapRequest returned error: %s", err)
+			}
+			if len(req) != pcpRequestSize {
+				t.Fatalf("len(req) = %d, want %d", len(req), pcpRequestSize)
+			}
+			if req[0] != pcpVersion {
+				t.Errorf("req[0] (version) = %d, want %d", req[0], pcpVersion)
+			}
+			if req[1] != pcpOpcodeMap {
+				t.Errorf("req[1] (opcode) = %d, want %d", req[1], pcpOpcodeMap)
+			}
+			if got := binary.BigEndian.Uint32(req[4:8]); got != uint32(tt.lifetime.Seconds()) {
+				t.Errorf("lifetime = %d, want %d", got, uint32(tt.lifetime.Seconds()))
+			}
+			wantIP := net.ParseIP(tt.internalIP).To16()
+			if !net.IP(req[8:24]).Equal(wantIP) {
+				t.Errorf("client IP = %v, want %v", net.IP(req[8:24]), wantIP)
+			}
+			if req[36] != tt.wantProtoNum {
+				t.Errorf("protocol number = %d, want %d", req[36], tt.wantProtoNum)
+			}
+			if got := binary.BigEndian.Uint16(req[40:42]); got != uint16(tt.internalPort) {
+				t.Errorf("internal port = %d, want %d", got, tt.internalPort)
+			}
+			if got := binary.BigEndian.Uint16(req[42:44]); got != uint16(tt.externalPort) {
+				t.Errorf("external port = %d, want %d", got, tt.externalPort)
+			}
+			// The suggested external IP must be left unset; the internal IP
+			// has no business being suggested as our WAN-facing address.
+			if suggested := net.IP(req[44:60]); !suggested.Equal(net.IPv6zero) {
+				t.Errorf("suggested external IP = %v, want all-zero", suggested)
+			}
+		})
+	}
+}
+
+func TestPCPMapRequestInvalidIP(t *testing.T) {
+	if _, err := pcpMapRequest(TCP, "not-an-ip", 8080, 443, time.Hour); err == nil {
+		t.Fatal("expected error for invalid internal IP, got nil")
+	}
+}
@@ -1,7 +1,9 @@
 package server
 
 import (
+	"context"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"os"
@@ -12,19 +14,37 @@ import (
 	"time"
 
 	"github.com/getlantern/fronted"
-	"github.com/getlantern/go-igdman/igdman"
 	"github.com/getlantern/golog"
 	"github.com/getlantern/nattywad"
 	"github.com/getlantern/waddell"
 
 	"github.com/getlantern/flashlight/globals"
+	"github.com/getlantern/flashlight/health"
 	"github.com/getlantern/flashlight/nattest"
 	"github.com/getlantern/flashlight/statreporter"
 	"github.com/getlantern/flashlight/statserver"
+	"github.com/getlantern/flashlight/xlog"
 )
 
 const (
 	PortmapFailure = 50
+
+	// certExpiryWarning is how far ahead of a certificate's expiry the cert
+	// health check starts reporting unhealthy, giving operators time to
+	// rotate it before clients actually start seeing failures.
+	certExpiryWarning = 14 * 24 * time.Hour
+
+	// canaryHost is dialed periodically to make sure this server still has
+	// a working upstream path to the open Internet.
+	canaryHost = "www.google.com:443"
+
+	dialTimeout = 5 * time.Second
+
+	// shutdownDrainPoll is how long Shutdown waits for in-flight
+	// connections to finish on their own before moving on to tearing down
+	// the rest of the server, absent a shorter deadline on the passed-in
+	// context.
+	shutdownDrainPoll = 5 * time.Second
 )
 
 var (
@@ -74,6 +94,22 @@ type Server struct {
 	nattywadServer *nattywad.Server
 	cfg            *ServerConfig
 	cfgMutex       sync.Mutex
+	portmap        portmapState
+	health         *health.Registry
+	adminStarted   bool
+
+	ctx      context.Context
+	listener net.Listener
+}
+
+// ctxOrBackground returns the context.Context passed to the most recent
+// call to ListenAndServe, or context.Background() if ListenAndServe hasn't
+// been called yet (e.g. Configure is called standalone in tests).
+func (server *Server) ctxOrBackground() context.Context {
+	if server.ctx != nil {
+		return server.ctx
+	}
+	return context.Background()
 }
 
 func (server *Server) Configure(newCfg *ServerConfig) {
@@ -90,24 +126,31 @@ func (server *Server) Configure(newCfg *ServerConfig) {
 
 	if oldCfg == nil || newCfg.Portmap != oldCfg.Portmap {
 		// Portmap changed
-		if oldCfg != nil && oldCfg.Portmap > 0 {
+		server.portmap.mutex.Lock()
+		if server.portmap.tcp != nil {
 			log.Debugf("Attempting to unmap old external port %d", oldCfg.Portmap)
-			err := unmapPort(oldCfg.Portmap)
-			if err != nil {
+			if err := server.portmap.tcp.unmap(); err != nil {
 				log.Errorf("Unable to unmap old external port: %s", err)
 			}
+			server.portmap.tcp = nil
 			log.Debugf("Unmapped old external port %d", oldCfg.Portmap)
 		}
 
 		if newCfg.Portmap > 0 {
 			log.Debugf("Attempting to map new external port %d", newCfg.Portmap)
-			err := mapPort(server.Addr, newCfg.Portmap)
+			lease, err := server.mapTCPPort(newCfg.Portmap)
 			if err != nil {
+				// Either our internal address couldn't be determined or
+				// every backend (IGD, NAT-PMP, PCP) failed; a single
+				// backend failing doesn't get us here.
 				log.Errorf("Unable to map new external port: %s", err)
+				server.portmap.mutex.Unlock()
 				os.Exit(PortmapFailure)
 			}
+			server.portmap.tcp = lease
 			log.Debugf("Mapped new external port %d", newCfg.Portmap)
 		}
+		server.portmap.mutex.Unlock()
 	}
 
 	nattywadIsEnabled := newCfg.WaddellAddr != ""
@@ -116,20 +159,39 @@ func (server *Server) Configure(newCfg *ServerConfig) {
 
 	if waddellAddrChanged {
 		if nattywadWasEnabled {
-			server.stopNattywad()
+			server.stopNattywad(server.ctxOrBackground())
 		}
 		if nattywadIsEnabled {
-			server.startNattywad(newCfg.WaddellAddr)
+			server.startNattywad(server.ctxOrBackground(), newCfg.WaddellAddr)
 		}
 	}
 
 	if newCfg.FrontFQDNs != nil {
 		server.HostFn = hostFn(newCfg.FrontFQDNs)
 	}
+
+	if newCfg.AdminAddr != "" && !server.adminStarted {
+		// The admin endpoint serves server.health, which only exists once
+		// ListenAndServe has run; if Configure is called first, it's started
+		// from there instead once health is available.
+		if server.health != nil {
+			server.startAdmin(newCfg.AdminAddr)
+		}
+	}
+
 	server.cfg = newCfg
 }
 
-func (server *Server) ListenAndServe() error {
+// ListenAndServe starts serving fronted connections and blocks until either
+// an unrecoverable error occurs or ctx is cancelled, in which case it closes
+// the listener and returns nil.
+func (server *Server) ListenAndServe(ctx context.Context) error {
+	server.ctx = ctx
+	server.health = health.NewRegistry()
+	server.registerHealthChecks()
+	if server.cfg != nil && server.cfg.AdminAddr != "" {
+		server.startAdmin(server.cfg.AdminAddr)
+	}
 
 	fs := &fronted.Server{
 		Addr:                       server.Addr,
@@ -144,14 +206,20 @@ func (server *Server) ListenAndServe() error {
 	if server.cfg.Unencrypted {
 		log.Debug("Running in unencrypted mode")
 		fs.CertContext = nil
+	} else if fs.CertContext != nil {
+		// Advertise muxALPNToken so that mux-aware clients can negotiate it
+		// during the handshake; see newMuxListener in mux.go.
+		fs.CertContext.AddALPNProtocol(muxALPNToken)
 	}
 
 	// Add callbacks to track bytes given
 	fs.OnBytesReceived = func(ip string, destAddr string, req *http.Request, bytes int64) {
+		requestLogger(ip, destAddr, req).V(2).Debugf("Received %d bytes", bytes)
 		onBytesGiven(destAddr, req, bytes)
 		statserver.OnBytesReceived(ip, bytes)
 	}
 	fs.OnBytesSent = func(ip string, destAddr string, req *http.Request, bytes int64) {
+		requestLogger(ip, destAddr, req).V(2).Debugf("Sent %d bytes", bytes)
 		onBytesGiven(destAddr, req, bytes)
 		statserver.OnBytesSent(ip, bytes)
 	}
@@ -160,15 +228,78 @@ func (server *Server) ListenAndServe() error {
 	if err != nil {
 		return fmt.Errorf("Unable to listen at %s: %s", server.Addr, err)
 	}
-	return fs.Serve(l)
+	// Demux mux-aware client connections (those that negotiated
+	// muxALPNToken) into their component logical streams before handing
+	// them to fs.Serve, so that successive requests from the same client
+	// can reuse one TLS handshake instead of paying for a new one each
+	// time.
+	l = newMuxListener(l)
+	server.listener = l
+
+	go func() {
+		<-ctx.Done()
+		log.Debug("Context cancelled, closing listener")
+		l.Close()
+	}()
+
+	err = fs.Serve(l)
+	if ctx.Err() != nil {
+		// The listener was closed because ctx was cancelled, not because of
+		// a real serving error.
+		return nil
+	}
+	return err
+}
+
+// Shutdown gracefully stops the server: it stops accepting new connections,
+// waits shutdownDrainPoll (or less, if ctx is done first) for in-flight
+// fronted connections to finish, unmaps the portmapped port, and tears down
+// waddell/nattywad.
+func (server *Server) Shutdown(ctx context.Context) error {
+	if server.listener != nil {
+		log.Debug("Closing listener")
+		server.listener.Close()
+	}
+
+	// fronted.Server doesn't currently expose a way to wait on in-flight
+	// connections draining, so the best we can do is give them a fixed
+	// shutdownDrainPoll, cut short if ctx is done, to finish on their own
+	// before we tear down the rest. Whether they actually finished is not
+	// checked.
+	select {
+	case <-time.After(shutdownDrainPoll):
+	case <-ctx.Done():
+	}
+
+	server.portmap.mutex.Lock()
+	if server.portmap.tcp != nil {
+		log.Debug("Unmapping external port")
+		if err := server.portmap.tcp.unmap(); err != nil {
+			log.Errorf("Unable to unmap port during shutdown: %s", err)
+		}
+		server.portmap.tcp = nil
+	}
+	server.portmap.mutex.Unlock()
+
+	server.stopNattywad(ctx)
+
+	if server.health != nil {
+		// Deregister every check we registered in registerHealthChecks so
+		// their ticker goroutines don't keep running past shutdown.
+		for _, name := range []string{"listen-socket", "mux-sessions", "upstream-canary", "cert-expiry"} {
+			server.health.Deregister(name)
+		}
+	}
+
+	return nil
 }
 
-func (server *Server) startNattywad(waddellAddr string) {
+func (server *Server) startNattywad(ctx context.Context, waddellAddr string) {
 	log.Debugf("Connecting to waddell at: %s", waddellAddr)
 	var err error
 	server.waddellClient, err = waddell.NewClient(&waddell.ClientConfig{
 		Dial: func() (net.Conn, error) {
-			return net.Dial("tcp", waddellAddr)
+			return (&net.Dialer{}).DialContext(ctx, "tcp", waddellAddr)
 		},
 		ServerCert:        globals.WaddellCert,
 		ReconnectAttempts: 10,
@@ -179,8 +310,14 @@ func (server *Server) startNattywad(waddellAddr string) {
 	if err != nil {
 		log.Errorf("Unable to connect to waddell: %s", err)
 		server.waddellClient = nil
+		if server.health != nil {
+			server.health.Set("waddell", err)
+		}
 		return
 	}
+	if server.health != nil {
+		server.health.Set("waddell", nil)
+	}
 	server.nattywadServer = &nattywad.Server{
 		Client: server.waddellClient,
 		OnSuccess: func(local *net.UDPAddr, remote *net.UDPAddr) bool {
@@ -189,65 +326,119 @@ func (server *Server) startNattywad(waddellAddr string) {
 				log.Error(err.Error())
 				return false
 			}
+			// Also try to map a stable external UDP port for this local
+			// port, so that peers that can't rely on hole punching alone
+			// still have a predictable port to reach us on.
+			server.portmap.mutex.Lock()
+			lease, err := server.mapUDPPort(local.Port, local.Port)
+			if err != nil {
+				log.Debugf("Unable to map UDP port %d for nattywad: %s", local.Port, err)
+			} else {
+				server.portmap.udp = lease
+			}
+			server.portmap.mutex.Unlock()
 			return true
 		},
 	}
 	server.nattywadServer.Start()
+
+	go func() {
+		<-ctx.Done()
+		log.Debug("Context cancelled, stopping nattywad")
+		server.stopNattywad(ctx)
+	}()
 }
 
-func (server *Server) stopNattywad() {
+// stopNattywad is idempotent: it's safe to call even if nattywad is already
+// stopped, since it can be reached both from Configure reacting to a config
+// change and from the ctx-cancellation watcher started in startNattywad.
+func (server *Server) stopNattywad(ctx context.Context) {
+	if server.nattywadServer == nil {
+		return
+	}
+
 	log.Debug("Stopping nattywad server")
 	server.nattywadServer.Stop()
 	server.nattywadServer = nil
+	server.portmap.mutex.Lock()
+	if server.portmap.udp != nil {
+		if err := server.portmap.udp.unmap(); err != nil {
+			log.Errorf("Unable to unmap nattywad UDP port: %s", err)
+		}
+		server.portmap.udp = nil
+	}
+	server.portmap.mutex.Unlock()
 	log.Debug("Stopping waddell client")
 	server.waddellClient.Close()
 	server.waddellClient = nil
+	if server.health != nil {
+		server.health.Set("waddell", fmt.Errorf("nattywad stopped"))
+	}
 }
 
-func mapPort(addr string, port int) error {
-	internalIP, internalPortString, err := net.SplitHostPort(addr)
+// mapTCPPort maps the given external port to server.Addr over TCP, trying
+// each registered PortMapper backend in turn until one succeeds.
+func (server *Server) mapTCPPort(externalPort int) (*portmapLease, error) {
+	internalIP, internalPort, err := server.internalAddr()
 	if err != nil {
-		return fmt.Errorf("Unable to split host and port for %v: %v", addr, err)
+		return nil, err
 	}
+	return server.mapPort(TCP, internalIP, internalPort, externalPort)
+}
 
-	internalPort, err := strconv.Atoi(internalPortString)
+// mapUDPPort maps the given external port to internalPort over UDP. This is
+// used by the nattywad path so that clients have a stable external UDP port
+// to punch to, rather than relying solely on NAT traversal via STUN.
+func (server *Server) mapUDPPort(internalPort int, externalPort int) (*portmapLease, error) {
+	internalIP, _, err := server.internalAddr()
 	if err != nil {
-		return fmt.Errorf("Unable to parse local port: ")
+		return nil, err
 	}
+	return server.mapPort(UDP, internalIP, internalPort, externalPort)
+}
 
-	if internalIP == "" {
-		internalIP, err = determineInternalIP()
-		if err != nil {
-			return fmt.Errorf("Unable to determine internal IP: %s", err)
-		}
+func (server *Server) internalAddr() (string, int, error) {
+	internalIP, internalPortString, err := net.SplitHostPort(server.Addr)
+	if err != nil {
+		return "", 0, fmt.Errorf("Unable to split host and port for %v: %v", server.Addr, err)
 	}
 
-	igd, err := igdman.NewIGD()
+	internalPort, err := strconv.Atoi(internalPortString)
 	if err != nil {
-		return fmt.Errorf("Unable to get IGD: %s", err)
+		return "", 0, fmt.Errorf("Unable to parse local port: %v", err)
 	}
 
-	igd.RemovePortMapping(igdman.TCP, port)
-	err = igd.AddPortMapping(igdman.TCP, internalIP, internalPort, port, 0)
-	if err != nil {
-		return fmt.Errorf("Unable to map port with igdman %d: %s", port, err)
+	if internalIP == "" {
+		internalIP, err = determineInternalIP()
+		if err != nil {
+			return "", 0, fmt.Errorf("Unable to determine internal IP: %s", err)
+		}
 	}
 
-	return nil
+	return internalIP, internalPort, nil
 }
 
-func unmapPort(port int) error {
-	igd, err := igdman.NewIGD()
+// determineExternalIP determines this server's external (WAN-facing) IP by
+// asking a public echo service, since a server behind NAT has no local way
+// to know the address its port mappings are actually reachable at.
+func determineExternalIP() (string, error) {
+	client := http.Client{Timeout: dialTimeout}
+	resp, err := client.Get("https://api.ipify.org")
 	if err != nil {
-		return fmt.Errorf("Unable to get IGD: %s", err)
+		return "", fmt.Errorf("Unable to determine external IP: %s", err)
 	}
+	defer resp.Body.Close()
 
-	igd.RemovePortMapping(igdman.TCP, port)
+	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return fmt.Errorf("Unable to unmap port with igdman %d: %s", port, err)
+		return "", fmt.Errorf("Unable to read external IP response: %s", err)
 	}
 
-	return nil
+	ip := strings.TrimSpace(string(body))
+	if net.ParseIP(ip) == nil {
+		return "", fmt.Errorf("Got invalid external IP %q", ip)
+	}
+	return ip, nil
 }
 
 // determineInternalIP determines the internal IP to use for mapping ports. It
@@ -264,6 +455,115 @@ func determineInternalIP() (string, error) {
 	return host, err
 }
 
+// registerHealthChecks registers this server's periodic self-checks: that
+// its listen socket is reachable from its own external IP via the mapped
+// port, that its certificate isn't near expiry, and that it still has a
+// working upstream path to the open Internet.
+func (server *Server) registerHealthChecks() {
+	server.health.Register(health.Check{
+		Name: "listen-socket",
+		Fn: func() (map[string]interface{}, error) {
+			server.portmap.mutex.Lock()
+			lease := server.portmap.tcp
+			server.portmap.mutex.Unlock()
+			if lease == nil {
+				return nil, fmt.Errorf("No external port mapping established")
+			}
+
+			externalIP, err := determineExternalIP()
+			if err != nil {
+				return nil, err
+			}
+
+			addr := net.JoinHostPort(externalIP, strconv.Itoa(lease.externalPort))
+			conn, err := net.DialTimeout("tcp", addr, dialTimeout)
+			if err != nil {
+				return nil, fmt.Errorf("Unable to reach our own listen socket at %v: %v", addr, err)
+			}
+			conn.Close()
+			return nil, nil
+		},
+	})
+
+	server.health.Register(health.Check{
+		Name: "mux-sessions",
+		Fn: func() (map[string]interface{}, error) {
+			sessions, streams := muxStats()
+			return map[string]interface{}{
+				"sessions": sessions,
+				"streams":  streams,
+			}, nil
+		},
+	})
+
+	server.health.Register(health.Check{
+		Name: "upstream-canary",
+		Fn: func() (map[string]interface{}, error) {
+			conn, err := net.DialTimeout("tcp", canaryHost, dialTimeout)
+			if err != nil {
+				return nil, fmt.Errorf("Unable to dial canary host %v: %v", canaryHost, err)
+			}
+			conn.Close()
+			return nil, nil
+		},
+	})
+
+	if server.CertContext != nil {
+		server.health.Register(health.Check{
+			Name: "cert-expiry",
+			Fn: func() (map[string]interface{}, error) {
+				expiry := server.CertContext.Expiry()
+				if time.Now().Add(certExpiryWarning).After(expiry) {
+					return nil, fmt.Errorf("Certificate expires at %v, within the %v warning window", expiry, certExpiryWarning)
+				}
+				return nil, nil
+			},
+		})
+	}
+}
+
+// startAdmin starts the health admin HTTP endpoint, which serves the
+// aggregated health status as JSON at / and lets operators adjust logging
+// verbosity at runtime via /verbosity, so a single misbehaving peer's
+// traffic can be investigated without drowning in trace output from
+// everyone else's. It's idempotent, since Configure can be called again
+// with the same AdminAddr as configuration is reloaded over the server's
+// lifetime.
+func (server *Server) startAdmin(adminAddr string) {
+	if server.adminStarted {
+		return
+	}
+	server.adminStarted = true
+	mux := http.NewServeMux()
+	mux.Handle("/", server.health)
+	mux.HandleFunc("/verbosity", handleVerbosity)
+	go func() {
+		if err := http.ListenAndServe(adminAddr, mux); err != nil {
+			log.Errorf("Admin endpoint at %v stopped: %v", adminAddr, err)
+		}
+	}()
+}
+
+// handleVerbosity lets operators adjust logging verbosity at runtime via
+// POST /verbosity?level=N, or, with &key=<clientIp|dest>, raise it only for
+// log lines tagged with that key (e.g. one misbehaving peer) instead of
+// globally.
+func handleVerbosity(w http.ResponseWriter, req *http.Request) {
+	if req.Method == http.MethodPost {
+		level, err := strconv.Atoi(req.URL.Query().Get("level"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid level: %v", err), http.StatusBadRequest)
+			return
+		}
+		if key := req.URL.Query().Get("key"); key != "" {
+			xlog.SetVerbosityFor(key, level)
+		} else {
+			xlog.SetVerbosity(level)
+		}
+	}
+	fmt.Fprintf(w, "%d\n", xlog.Verbosity())
+}
+
 func onBytesGiven(destAddr string, req *http.Request, bytes int64) {
 	host, port, _ := net.SplitHostPort(destAddr)
 	if port == "" {
@@ -294,6 +594,27 @@ func onBytesGiven(destAddr string, req *http.Request, bytes int64) {
 	}
 }
 
+// requestLogger returns an xlog.Logger with fields identifying the client
+// IP, country, destination and fronting provider of req attached, so that
+// every line logged while handling this particular request can be traced
+// back to it without having to thread those values through by hand.
+func requestLogger(clientIP string, destAddr string, req *http.Request) *xlog.Logger {
+	return xlog.New(log).
+		With("clientIp", clientIP).
+		With("dest", destAddr).
+		With("country", req.Header.Get("Cf-Ipcountry")).
+		With("front", detectFrontingProvider(req))
+}
+
+func detectFrontingProvider(req *http.Request) string {
+	for provider, fn := range frontingProviders {
+		if fn(req) {
+			return provider
+		}
+	}
+	return ""
+}
+
 func hostFn(fqdns map[string]string) func(*http.Request) string {
 	// We prefer to use the fronting provider through which we have been reached,
 	// because we expect that to be unblocked, but if something goes wrong (e.g. in
@@ -0,0 +1,164 @@
+// Package xlog wraps golog with two things plain package loggers don't
+// give us: per-request structured fields that get attached to every line
+// emitted while handling that request, and tailscale-style V(n) verbosity
+// levels so a handful of spammy call sites can be silenced without losing
+// everything else.
+package xlog
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/getlantern/golog"
+)
+
+// verbosity is the process-wide default verbosity level, checked by every
+// V(n) call that isn't covered by a more specific override from
+// SetVerbosityFor. It starts at 0, meaning only V(0) (i.e. unconditional)
+// logging is enabled by default.
+var verbosity int32
+
+// SetVerbosity sets the process-wide default verbosity level used by V(n).
+// It's safe to call concurrently with logging, so operators can raise it
+// via the admin endpoint without restarting.
+func SetVerbosity(v int) {
+	atomic.StoreInt32(&verbosity, int32(v))
+}
+
+// Verbosity returns the current process-wide default verbosity level.
+func Verbosity() int {
+	return int(atomic.LoadInt32(&verbosity))
+}
+
+var (
+	overridesMutex sync.RWMutex
+	overrides      = map[string]int32{}
+)
+
+// SetVerbosityFor raises the verbosity level used by V(n) for log lines that
+// carry a field whose value equals key (e.g. a peer's IP, passed to With),
+// without affecting the verbosity of anyone else's log lines. This is what
+// lets an operator crank up tracing for one misbehaving peer without
+// drowning in trace output from all of them.
+func SetVerbosityFor(key string, v int) {
+	overridesMutex.Lock()
+	overrides[key] = int32(v)
+	overridesMutex.Unlock()
+}
+
+// ClearVerbosityFor removes any override previously set by SetVerbosityFor,
+// reverting key to the process-wide default verbosity.
+func ClearVerbosityFor(key string) {
+	overridesMutex.Lock()
+	delete(overrides, key)
+	overridesMutex.Unlock()
+}
+
+// verbosityFor returns the verbosity level that applies to a Logger with
+// the given fields attached: the highest override among its field values,
+// or the process-wide default if none of them have one.
+func verbosityFor(fields map[string]string) int32 {
+	level := atomic.LoadInt32(&verbosity)
+
+	overridesMutex.RLock()
+	defer overridesMutex.RUnlock()
+	if len(overrides) == 0 {
+		return level
+	}
+	for _, v := range fields {
+		if o, ok := overrides[v]; ok && o > level {
+			level = o
+		}
+	}
+	return level
+}
+
+// Logger wraps a golog.Logger, attaching a fixed set of key/value fields to
+// every line it emits.
+type Logger struct {
+	base   golog.Logger
+	fields map[string]string
+}
+
+// New wraps base in a Logger with no fields attached yet.
+func New(base golog.Logger) *Logger {
+	return &Logger{base: base}
+}
+
+// With returns a copy of this Logger that also attaches key=value to every
+// line it emits. The original Logger is left unmodified. An empty value is
+// not attached: l itself is returned unchanged.
+func (l *Logger) With(key, value string) *Logger {
+	if value == "" {
+		return l
+	}
+	fields := make(map[string]string, len(l.fields)+1)
+	for k, v := range l.fields {
+		fields[k] = v
+	}
+	fields[key] = value
+	return &Logger{base: l.base, fields: fields}
+}
+
+func (l *Logger) decorate(msg string) string {
+	if len(l.fields) == 0 {
+		return msg
+	}
+	keys := make([]string, 0, len(l.fields))
+	for k := range l.fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	prefix := ""
+	for _, k := range keys {
+		prefix += fmt.Sprintf("%s=%s ", k, l.fields[k])
+	}
+	return prefix + msg
+}
+
+func (l *Logger) Debug(args ...interface{}) {
+	l.base.Debug(l.decorate(fmt.Sprint(args...)))
+}
+
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.base.Debugf(l.decorate(fmt.Sprintf(format, args...)))
+}
+
+func (l *Logger) Error(args ...interface{}) {
+	l.base.Error(l.decorate(fmt.Sprint(args...)))
+}
+
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.base.Errorf(l.decorate(fmt.Sprintf(format, args...)))
+}
+
+// V returns a VLogger gated on this Logger's verbosity level: calls made
+// through it are emitted only when that level is at least `level`. The
+// level is the process-wide default unless one of this Logger's fields
+// (e.g. a peer IP attached via With) has been raised individually with
+// SetVerbosityFor, so that a single misbehaving peer can have its
+// verbosity cranked up without affecting everyone else.
+func (l *Logger) V(level int) VLogger {
+	return VLogger{logger: l, enabled: verbosityFor(l.fields) >= int32(level)}
+}
+
+// VLogger is a Logger gated on a particular verbosity level.
+type VLogger struct {
+	logger  *Logger
+	enabled bool
+}
+
+func (v VLogger) Debug(args ...interface{}) {
+	if v.enabled {
+		v.logger.Debug(args...)
+	}
+}
+
+func (v VLogger) Debugf(format string, args ...interface{}) {
+	if v.enabled {
+		v.logger.Debugf(format, args...)
+	}
+}
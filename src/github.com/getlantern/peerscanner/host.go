@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
 	"io"
@@ -13,9 +14,11 @@ import (
 
 	"github.com/getlantern/cloudflare"
 	"github.com/getlantern/enproxy"
+	"github.com/getlantern/flashlight/xlog"
 	"github.com/getlantern/peerscanner/cfr"
 	"github.com/getlantern/tlsdialer"
 	"github.com/getlantern/withtimeout"
+	"github.com/getlantern/yamux"
 )
 
 var (
@@ -45,6 +48,7 @@ var (
 type status struct {
 	online            bool
 	connectionRefused bool
+	proxyUnreachable  bool
 }
 
 // host is an actor that represents a host entry in CloudFlare and is
@@ -71,6 +75,23 @@ type host struct {
 	proxiedClient     *http.Client
 	reportedHost      string
 	reportedHostMutex sync.Mutex
+
+	// ProxyDialer, if non-nil, is used to reach the host instead of dialing
+	// it directly. This lets the scanner operate even when it's itself
+	// running behind a corporate or egress proxy. Defaults to
+	// defaultProxyDialer, which is configured from the environment.
+	ProxyDialer dialFunc
+
+	// xl is a per-host logger so that spammy per-test trace lines can be
+	// told apart and, via xlog's V(n) levels, cranked up for one
+	// misbehaving peer without drowning in trace output from all of them.
+	xl *xlog.Logger
+
+	// muxSession, once established, is reused across successive probes so
+	// that they share a single TLS handshake instead of paying for a new
+	// one per probe.
+	muxMutex   sync.Mutex
+	muxSession *yamux.Session
 }
 
 func (h *host) String() string {
@@ -94,15 +115,15 @@ func newHost(name string, ip string, record *cloudflare.Record) *host {
 		unregisterCh: make(chan interface{}, 1),
 		statusCh:     make(chan chan *status, 1000),
 		initCfrCh:    make(chan interface{}, 1),
+		ProxyDialer:  defaultProxyDialer,
 	}
+	h.xl = xlog.New(log).With("dest", ip+":443")
 	h.proxiedClient = &http.Client{
 		Transport: &http.Transport{
 			Dial: func(network, addr string) (net.Conn, error) {
 				return enproxy.Dial(addr, &enproxy.Config{
 					DialProxy: func(addr string) (net.Conn, error) {
-						return tlsdialer.DialWithDialer(&net.Dialer{
-							Timeout: dialTimeout,
-						}, "tcp", ip+":443", true, &tls.Config{
+						return h.dialMuxStream(&tls.Config{
 							InsecureSkipVerify: true,
 							ClientSessionCache: clientSessionCache,
 						})
@@ -144,16 +165,16 @@ func newHost(name string, ip string, record *cloudflare.Record) *host {
 }
 
 // status returns the status of this host as of the next scheduled check
-func (h *host) status() (online bool, connectionRefused bool, timedOut bool) {
+func (h *host) status() (online bool, connectionRefused bool, proxyUnreachable bool, timedOut bool) {
 	// Buffer the channel so that if we time out, reportStatus can still report
 	// without blocking.
 	sch := make(chan *status, 1)
 	h.statusCh <- sch
 	select {
 	case s := <-sch:
-		return s.online, s.connectionRefused, false
+		return s.online, s.connectionRefused, s.proxyUnreachable, false
 	case <-time.After(statusTimeout):
-		return false, false, true
+		return false, false, false, true
 	}
 }
 
@@ -202,8 +223,10 @@ func (h *host) doInitCfrDist() {
  * Implementation
  ******************************************************************************/
 
-// run is the main run loop for this host
-func (h *host) run() {
+// run is the main run loop for this host. It runs until ctx is cancelled,
+// at which point it returns without deregistering, leaving that to whatever
+// is orchestrating the shutdown (or reconfiguration) that cancelled ctx.
+func (h *host) run(ctx context.Context) {
 	checkImmediately := true
 	h.lastSuccess = time.Now()
 	h.lastTest = time.Now()
@@ -214,7 +237,7 @@ func (h *host) run() {
 		if !checkImmediately {
 			// Limit the rate at which we run tests
 			waitTime := h.lastTest.Add(testPeriod).Sub(time.Now())
-			log.Tracef("Waiting %v until testing %v", waitTime, h)
+			h.xl.V(2).Debugf("Waiting %v until testing %v", waitTime, h)
 			periodTimer.Reset(waitTime)
 		}
 
@@ -222,25 +245,32 @@ func (h *host) run() {
 		pauseTimer.Reset(h.lastSuccess.Add(pauseAfter).Sub(time.Now()))
 
 		select {
+		case <-ctx.Done():
+			log.Debugf("%v cancelled, stopping run loop", h)
+			return
 		case newName := <-h.resetCh:
 			h.doReset(newName)
 		case <-h.unregisterCh:
 			log.Debugf("Unregistering %v and pausing", h)
-			h.pause()
+			if !h.pause(ctx) {
+				return
+			}
 			checkImmediately = true
 		case <-h.initCfrCh:
 			h.doInitCfrDist()
 		case <-pauseTimer.C:
 			log.Debugf("%v had no successful checks or resets in %v, pausing", h, pauseAfter)
-			h.pause()
+			if !h.pause(ctx) {
+				return
+			}
 			checkImmediately = true
 		case <-periodTimer.C:
-			log.Tracef("Testing %v", h)
+			h.xl.V(1).Debugf("Testing %v", h)
 			_s, timedOut, err := withtimeout.Do(ttl, func() (interface{}, error) {
-				online, connectionRefused, err := h.isAbleToProxy()
-				return &status{online, connectionRefused}, err
+				online, connectionRefused, proxyUnreachable, err := h.isAbleToProxy()
+				return &status{online, connectionRefused, proxyUnreachable}, err
 			})
-			s := &status{false, false}
+			s := &status{false, false, false}
 			if timedOut {
 				log.Debugf("Testing %v timed out unexpectedly", h)
 			}
@@ -251,34 +281,45 @@ func (h *host) run() {
 			h.lastTest = time.Now()
 			checkImmediately = false
 			if s.online {
-				log.Tracef("Test for %v successful", h)
+				h.xl.V(1).Debugf("Test for %v successful", h)
 				h.lastSuccess = time.Now()
 				err := h.register()
 				if err != nil {
 					log.Error(err)
 				}
 			} else {
-				log.Tracef("Test for %v failed with error: %v", h, err)
-				// Deregister this host from its rotations. We leave the host
-				// itself registered to support continued sticky routing in case
-				// any clients still have connections open to it.
-				h.deregisterFromRotations()
+				h.xl.V(1).Debugf("Test for %v failed with error: %v", h, err)
+				if s.proxyUnreachable {
+					// Our own egress path is broken, not the host's. Leave
+					// the host's rotations alone so we don't deregister a
+					// healthy peer because of a problem on our end.
+					h.xl.V(1).Debugf("Not deregistering %v from rotations; proxy unreachable", h)
+				} else {
+					// Deregister this host from its rotations. We leave the host
+					// itself registered to support continued sticky routing in case
+					// any clients still have connections open to it.
+					h.deregisterFromRotations()
+				}
 			}
 		}
 	}
 }
 
 // pause deregisters this host completely and then waits for the next reset
-// before continuing
-func (h *host) pause() {
+// before continuing. It returns false if ctx was cancelled while paused,
+// signalling to the caller that the run loop should exit rather than resume.
+func (h *host) pause(ctx context.Context) bool {
 	h.deregister()
 	log.Debugf("%v paused", h)
 	for {
 		select {
+		case <-ctx.Done():
+			log.Debugf("%v cancelled while paused", h)
+			return false
 		case newName := <-h.resetCh:
 			log.Debugf("Unpausing checks for %v", h)
 			h.doReset(newName)
-			return
+			return true
 		case <-h.unregisterCh:
 			log.Tracef("Ignoring unregister while paused")
 		}
@@ -475,15 +516,94 @@ func (h *host) isFallback() bool {
 	return isCdnFallback(h.name)
 }
 
-func (h *host) isAbleToProxy() (bool, bool, error) {
+// dial reaches addr either directly or, if h.ProxyDialer is set, through the
+// configured outbound proxy.
+func (h *host) dial(network, addr string) (net.Conn, error) {
+	if h.ProxyDialer != nil {
+		return h.ProxyDialer(network, addr)
+	}
+	return net.DialTimeout(network, addr, dialTimeout)
+}
+
+// muxALPNToken must match the token the flashlight server's fronted
+// listener checks for when deciding whether to treat an incoming
+// connection as a mux session rather than a plain request.
+const muxALPNToken = "lantern/mux1"
+
+// dialMuxStream returns a logical stream to h over a shared TLS+mux
+// session, establishing that session on first use and reusing it for
+// subsequent calls so that successive probes avoid a full TLS handshake
+// each time.
+func (h *host) dialMuxStream(config *tls.Config) (net.Conn, error) {
+	h.muxMutex.Lock()
+	defer h.muxMutex.Unlock()
+
+	if h.muxSession == nil || h.muxSession.IsClosed() {
+		muxConfig := config.Clone()
+		muxConfig.NextProtos = append(muxConfig.NextProtos, muxALPNToken)
+
+		conn, err := h.dialTLS(h.ip+":443", muxConfig)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConn, ok := conn.(*tls.Conn)
+		if !ok || tlsConn.ConnectionState().NegotiatedProtocol != muxALPNToken {
+			// h doesn't speak mux (older binary, partial rollout, third-party
+			// front); fall back to treating this as a plain, one-shot
+			// connection rather than framing it as a mux session, mirroring
+			// muxListener.handle's fallback on the server side.
+			return conn, nil
+		}
+
+		session, err := yamux.Client(conn, nil)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("Unable to establish mux session with %v: %v", h, err)
+		}
+		h.muxSession = session
+	}
+
+	return h.muxSession.Open()
+}
+
+// dialTLS reaches addr and performs a TLS handshake over the connection,
+// using h.ProxyDialer when configured and tlsdialer's faster direct path
+// otherwise.
+func (h *host) dialTLS(addr string, config *tls.Config) (net.Conn, error) {
+	if h.ProxyDialer == nil {
+		return tlsdialer.DialWithDialer(&net.Dialer{
+			Timeout: dialTimeout,
+		}, "tcp", addr, true, config)
+	}
+
+	conn, err := h.ProxyDialer("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+func (h *host) isAbleToProxy() (bool, bool, bool, error) {
 	// Check whether or not we can proxy a few times
 	var lastErr error
 	for i := 0; i < proxyAttempts; i++ {
-		success, connectionRefused, err := h.doIsAbleToProxy()
+		success, connectionRefused, proxyUnreachable, err := h.doIsAbleToProxy()
 		if err != nil {
 			log.Debugf("Error testing %v: %v", h, err.Error())
 		}
 		lastErr = err
+		if proxyUnreachable {
+			// Our own egress path is broken, not the host's. Report this
+			// distinctly so that callers don't mistake it for the host
+			// itself being down and wrongly deregister a healthy peer.
+			return false, false, true, err
+		}
 		if success || connectionRefused {
 			// If we've succeeded, or our connection was flat-out refused, don't
 			// bother trying to proxy again
@@ -500,22 +620,25 @@ func (h *host) isAbleToProxy() (bool, bool, error) {
 				}
 			}
 
-			return success, connectionRefused, lastErr
+			return success, connectionRefused, false, lastErr
 		}
 	}
-	return false, false, lastErr
+	return false, false, false, lastErr
 }
 
-func (h *host) doIsAbleToProxy() (bool, bool, error) {
+func (h *host) doIsAbleToProxy() (online bool, connectionRefused bool, proxyUnreachable bool, err error) {
 	// First just try a plain TCP connection. This is useful because the
 	// underlying TCP-level error is consumed in the flashlight layer, and we
 	// need that to be accessible on the client side in the logic for deciding
 	// whether or not to display the port mapping message.
 	addr := h.ip + ":443"
-	conn, err := net.DialTimeout("tcp", addr, dialTimeout)
+	conn, err := h.dial("tcp", addr)
 	if err != nil {
+		if isProxyUnreachable(err) {
+			return false, false, true, fmt.Errorf("Unable to reach proxy for %v: %v", addr, err)
+		}
 		err2 := fmt.Errorf("Unable to connect to %v: %v", addr, err)
-		return false, strings.Contains(err.Error(), "connection refused"), err2
+		return false, strings.Contains(err.Error(), "connection refused"), false, err2
 	}
 	conn.Close()
 
@@ -523,16 +646,19 @@ func (h *host) doIsAbleToProxy() (bool, bool, error) {
 	site := testSites[rand.Intn(len(testSites))]
 	resp, err := h.proxiedClient.Head("http://" + site)
 	if err != nil {
-		return false, false, fmt.Errorf("Unable to make proxied HEAD request to %v: %v", site, err)
+		if isProxyUnreachable(err) {
+			return false, false, true, fmt.Errorf("Unable to reach proxy for %v: %v", site, err)
+		}
+		return false, false, false, fmt.Errorf("Unable to make proxied HEAD request to %v: %v", site, err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != 200 && resp.StatusCode != 301 {
 		err2 := fmt.Errorf("Proxying to %v via %v returned unexpected status %d,", site, h.ip, resp.StatusCode)
-		return false, false, err2
+		return false, false, false, err2
 	}
 
-	return true, false, nil
+	return true, false, false, nil
 }
 
 func isDuplicateError(err error) bool {
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dialFunc dials addr over network, optionally through an outbound proxy.
+type dialFunc func(network, addr string) (net.Conn, error)
+
+// defaultProxyDialer is the dialFunc used by newly created hosts to reach
+// the outside world, configured from HTTPS_PROXY/ALL_PROXY at process
+// startup. It's nil (meaning "dial directly") when no proxy is configured.
+//
+// This is a package-level var rather than a constant so that tests can
+// override it with a dialer pointed at a local forward proxy, the same
+// override-hook pattern etcd uses for its dialers.
+var defaultProxyDialer = proxyDialerFromEnv()
+
+// proxyUnreachableError marks a dial failure that happened while trying to
+// reach the proxy itself, as opposed to a failure reported by the proxy
+// about the ultimate destination. Callers use this distinction to avoid
+// deregistering a healthy peer just because the scanner's own egress path
+// is broken.
+type proxyUnreachableError struct {
+	cause error
+}
+
+func (e *proxyUnreachableError) Error() string {
+	return fmt.Sprintf("proxy unreachable: %v", e.cause)
+}
+
+func isProxyUnreachable(err error) bool {
+	if err == nil {
+		return false
+	}
+	// http.Client wraps dial errors in a *url.Error, so also check the
+	// textual form as a fallback in case the original typed error got
+	// obscured along the way.
+	if urlErr, ok := err.(*url.Error); ok {
+		return isProxyUnreachable(urlErr.Err)
+	}
+	_, ok := err.(*proxyUnreachableError)
+	if ok {
+		return true
+	}
+	return strings.Contains(err.Error(), "proxy unreachable")
+}
+
+func proxyDialerFromEnv() dialFunc {
+	proxyURL := firstNonEmptyEnv("HTTPS_PROXY", "https_proxy", "ALL_PROXY", "all_proxy")
+	if proxyURL == "" {
+		return nil
+	}
+
+	dialer, err := newProxyDialer(proxyURL)
+	if err != nil {
+		log.Errorf("Unable to configure proxy dialer from %v: %v", proxyURL, err)
+		return nil
+	}
+	return dialer
+}
+
+func firstNonEmptyEnv(names ...string) string {
+	for _, name := range names {
+		if v := os.Getenv(name); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+func newProxyDialer(proxyURL string) (dialFunc, error) {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse proxy URL %v: %v", proxyURL, err)
+	}
+
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		return socks5Dialer(u.Host), nil
+	case "http", "https", "":
+		return httpConnectDialer(u.Host), nil
+	default:
+		return nil, fmt.Errorf("Unsupported proxy scheme %v", u.Scheme)
+	}
+}
+
+// httpConnectDialer returns a dialFunc that reaches addr by issuing an HTTP
+// CONNECT to the proxy at proxyAddr.
+func httpConnectDialer(proxyAddr string) dialFunc {
+	return func(network, addr string) (net.Conn, error) {
+		conn, err := net.DialTimeout(network, proxyAddr, dialTimeout)
+		if err != nil {
+			return nil, &proxyUnreachableError{err}
+		}
+
+		conn.SetDeadline(time.Now().Add(dialTimeout))
+		if _, err := fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", addr, addr); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("Unable to send CONNECT to proxy at %v: %v", proxyAddr, err)
+		}
+
+		resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "CONNECT"})
+		if err != nil || resp.StatusCode != http.StatusOK {
+			conn.Close()
+			return nil, fmt.Errorf("Proxy at %v refused CONNECT to %v: %v", proxyAddr, addr, err)
+		}
+		conn.SetDeadline(time.Time{})
+		return conn, nil
+	}
+}
+
+// socks5Dialer returns a dialFunc that reaches addr through a SOCKS5 proxy
+// at proxyAddr, per RFC 1928. Only the no-authentication method is
+// supported, which is all that outbound egress proxies typically need.
+func socks5Dialer(proxyAddr string) dialFunc {
+	return func(network, addr string) (net.Conn, error) {
+		conn, err := net.DialTimeout(network, proxyAddr, dialTimeout)
+		if err != nil {
+			return nil, &proxyUnreachableError{err}
+		}
+		if err := socks5Connect(conn, addr); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+}
+
+func socks5Connect(conn net.Conn, addr string) error {
+	conn.SetDeadline(time.Now().Add(dialTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	if _, err := conn.Write([]byte{0x05, 0x01, 0x00}); err != nil {
+		return fmt.Errorf("Unable to negotiate with SOCKS5 proxy: %v", err)
+	}
+	methodResp := make([]byte, 2)
+	if _, err := io.ReadFull(conn, methodResp); err != nil {
+		return fmt.Errorf("Unable to read SOCKS5 method selection: %v", err)
+	}
+	if methodResp[0] != 0x05 || methodResp[1] != 0x00 {
+		return fmt.Errorf("SOCKS5 proxy rejected our authentication method")
+	}
+
+	host, portString, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("Unable to split host and port for %v: %v", addr, err)
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil {
+		return fmt.Errorf("Unable to parse port for %v: %v", addr, err)
+	}
+
+	req := []byte{0x05, 0x01, 0x00, 0x03, byte(len(host))}
+	req = append(req, []byte(host)...)
+	req = append(req, byte(port>>8), byte(port))
+	if _, err := conn.Write(req); err != nil {
+		return fmt.Errorf("Unable to send SOCKS5 CONNECT request: %v", err)
+	}
+
+	respHeader := make([]byte, 4)
+	if _, err := io.ReadFull(conn, respHeader); err != nil {
+		return fmt.Errorf("Unable to read SOCKS5 CONNECT reply: %v", err)
+	}
+	if respHeader[1] != 0x00 {
+		return fmt.Errorf("SOCKS5 proxy refused CONNECT to %v, reply code %d", addr, respHeader[1])
+	}
+
+	// Drain the bound address in the reply; its length depends on the
+	// address type the proxy chose to report and we don't otherwise need it.
+	switch respHeader[3] {
+	case 0x01:
+		_, err = io.CopyN(ioutil.Discard, conn, 4+2)
+	case 0x03:
+		lenByte := make([]byte, 1)
+		if _, err = io.ReadFull(conn, lenByte); err == nil {
+			_, err = io.CopyN(ioutil.Discard, conn, int64(lenByte[0])+2)
+		}
+	case 0x04:
+		_, err = io.CopyN(ioutil.Discard, conn, 16+2)
+	default:
+		err = fmt.Errorf("Unrecognized SOCKS5 address type %d", respHeader[3])
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to read SOCKS5 bound address: %v", err)
+	}
+	return nil
+}
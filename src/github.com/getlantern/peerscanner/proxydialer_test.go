@@ -0,0 +1,110 @@
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+// fakeSOCKS5Server reads one method-negotiation and one CONNECT request off
+// conn and writes back the given canned responses, mimicking just enough of
+// a SOCKS5 proxy (RFC 1928) to drive socks5Connect.
+func fakeSOCKS5Server(t *testing.T, conn net.Conn, connectReply []byte) {
+	t.Helper()
+	methodReq := make([]byte, 3)
+	if _, err := io.ReadFull(conn, methodReq); err != nil {
+		t.Errorf("server: reading method negotiation: %s", err)
+		return
+	}
+	if _, err := conn.Write([]byte{0x05, 0x00}); err != nil {
+		t.Errorf("server: writing method selection: %s", err)
+		return
+	}
+
+	// Read and discard the CONNECT request: 4 fixed bytes, a length-prefixed
+	// domain name, and a 2-byte port.
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		t.Errorf("server: reading CONNECT header: %s", err)
+		return
+	}
+	rest := make([]byte, int(header[4])+2)
+	if _, err := io.ReadFull(conn, rest); err != nil {
+		t.Errorf("server: reading CONNECT host/port: %s", err)
+		return
+	}
+
+	if _, err := conn.Write(connectReply); err != nil {
+		t.Errorf("server: writing CONNECT reply: %s", err)
+	}
+}
+
+func TestSocks5ConnectSuccess(t *testing.T) {
+	tests := []struct {
+		name  string
+		reply []byte
+	}{
+		{"IPv4 bound address", []byte{0x05, 0x00, 0x00, 0x01, 1, 2, 3, 4, 0x01, 0xBB}},
+		{"domain bound address", append([]byte{0x05, 0x00, 0x00, 0x03, 7}, append([]byte("example"), 0x01, 0xBB)...)},
+		{"IPv6 bound address", append([]byte{0x05, 0x00, 0x00, 0x04}, append(make([]byte, 16), 0x01, 0xBB)...)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			defer server.Close()
+
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				fakeSOCKS5Server(t, server, tt.reply)
+			}()
+
+			if err := socks5Connect(client, "example.com:443"); err != nil {
+				t.Fatalf("socks5Connect returned error: %s", err)
+			}
+			<-done
+		})
+	}
+}
+
+func TestSocks5ConnectRefused(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// Reply code 0x05 is "Connection refused" per RFC 1928.
+		fakeSOCKS5Server(t, server, []byte{0x05, 0x05, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+	}()
+
+	if err := socks5Connect(client, "example.com:443"); err == nil {
+		t.Fatal("expected error for refused CONNECT, got nil")
+	}
+	// socks5Connect gives up after the 4-byte reply header, and net.Pipe is
+	// unbuffered, so read the 6-byte bound address it left behind to let the
+	// fake server's write complete.
+	if _, err := io.ReadFull(client, make([]byte, 6)); err != nil {
+		t.Fatalf("draining rest of CONNECT reply: %s", err)
+	}
+	<-done
+}
+
+func TestSocks5ConnectUnrecognizedAddressType(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		fakeSOCKS5Server(t, server, []byte{0x05, 0x00, 0x00, 0x7F})
+	}()
+
+	if err := socks5Connect(client, "example.com:443"); err == nil {
+		t.Fatal("expected error for unrecognized address type, got nil")
+	}
+	<-done
+}